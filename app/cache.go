@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobCache is a content-addressed store of registry blobs (layers and
+// image configs) on disk, keyed by digest, so repeated `run` invocations of
+// the same image skip the network entirely. It mirrors the layout real
+// registry clients (go-containerregistry, containerd's content store) use:
+// $XDG_CACHE_HOME/docker-go/blobs/<algo>/<hex>.
+type BlobCache struct {
+	dir string
+}
+
+// NewBlobCache opens the on-disk blob cache, creating it if necessary.
+func NewBlobCache() (*BlobCache, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("resolving cache dir: %w", err)
+	}
+
+	dir := filepath.Join(base, "docker-go", "blobs")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache dir %q: %w", dir, err)
+	}
+
+	return &BlobCache{dir: dir}, nil
+}
+
+func (c *BlobCache) path(digest string) (string, error) {
+	algo, digestHex, ok := strings.Cut(digest, ":")
+	if !ok || digestHex == "" {
+		return "", fmt.Errorf("malformed digest %q", digest)
+	}
+
+	return filepath.Join(c.dir, algo, digestHex), nil
+}
+
+// Lookup returns the cached path for digest, if it's already there.
+func (c *BlobCache) Lookup(digest string) (string, bool) {
+	path, err := c.path(digest)
+	if err != nil {
+		return "", false
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+// Store verifies r's sha256 matches digest while copying it into the cache,
+// writing to a temp file first so a crash mid-download can never leave a
+// corrupt blob at its final path. It returns the path the blob was stored at.
+func (c *BlobCache) Store(digest string, r io.Reader) (string, error) {
+	path, err := c.path(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(r, hasher)); err != nil {
+		return "", fmt.Errorf("writing blob: %w", err)
+	}
+
+	if got := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); got != digest {
+		return "", fmt.Errorf("digest mismatch: got %s, want %s", got, digest)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("placing blob in cache: %w", err)
+	}
+
+	return path, nil
+}
+
+// FetchBlob resolves digest to a local file path, serving it from cache when
+// present and otherwise downloading it through client, verifying its digest
+// along the way. onRead, if non-nil, is called with each chunk's size as
+// the blob is read, letting callers drive a progress display; it is called
+// once with the whole size for a cache hit.
+func FetchBlob(client *RegistryClient, cache *BlobCache, digest string, onRead func(n int64)) (string, error) {
+	if path, ok := cache.Lookup(digest); ok {
+		if onRead != nil {
+			if info, err := os.Stat(path); err == nil {
+				onRead(info.Size())
+			}
+		}
+		return path, nil
+	}
+
+	body, err := client.GetBlob(digest)
+	if err != nil {
+		return "", fmt.Errorf("requesting blob %s: %w", digest, err)
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if onRead != nil {
+		r = &progressReader{r: body, onRead: onRead}
+	}
+
+	path, err := cache.Store(digest, r)
+	if err != nil {
+		return "", fmt.Errorf("caching blob %s: %w", digest, err)
+	}
+
+	return path, nil
+}
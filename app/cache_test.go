@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCache(t *testing.T) *BlobCache {
+	t.Helper()
+	return &BlobCache{dir: t.TempDir()}
+}
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestBlobCacheStore(t *testing.T) {
+	const content = "hello layer"
+	validDigest := digestOf(content)
+
+	tests := []struct {
+		name    string
+		digest  string
+		content string
+		wantErr bool
+	}{
+		{name: "matching digest is stored", digest: validDigest, content: content},
+		{name: "digest mismatch is rejected", digest: "sha256:" + strings.Repeat("0", 64), content: content, wantErr: true},
+		{name: "malformed digest is rejected", digest: "not-a-digest", content: content, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestCache(t)
+
+			path, err := cache.Store(tt.digest, strings.NewReader(tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Store(%q): expected error, got path %q", tt.digest, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Store(%q): unexpected error: %v", tt.digest, err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading stored blob: %v", err)
+			}
+			if string(got) != tt.content {
+				t.Fatalf("stored content = %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
+
+func TestBlobCacheStoreRejectsLeavesNoTempFiles(t *testing.T) {
+	cache := newTestCache(t)
+	badDigest := "sha256:" + strings.Repeat("f", 64)
+
+	if _, err := cache.Store(badDigest, strings.NewReader("mismatched content")); err == nil {
+		t.Fatalf("Store: expected digest mismatch error")
+	}
+
+	dir, err := cache.path(badDigest)
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		t.Fatalf("reading algo dir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			t.Fatalf("leftover temp file %q after rejected store", entry.Name())
+		}
+	}
+}
+
+func TestBlobCacheLookup(t *testing.T) {
+	cache := newTestCache(t)
+	digest := digestOf("cached content")
+
+	if _, ok := cache.Lookup(digest); ok {
+		t.Fatalf("Lookup: expected miss before Store")
+	}
+
+	if _, err := cache.Store(digest, strings.NewReader("cached content")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	path, ok := cache.Lookup(digest)
+	if !ok {
+		t.Fatalf("Lookup: expected hit after Store")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stat cached blob: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// cgroupRoot is where docker-go keeps its containers' cgroup v2 leaves.
+const cgroupRoot = "/sys/fs/cgroup/docker-go"
+
+// cpuPeriodMicros is the cpu.max period docker-go uses; --cpus is expressed
+// as a quota against this period, the same way dockerd's default does.
+const cpuPeriodMicros = 100000
+
+// CgroupLimits are the resource knobs exposed via --memory/--cpus. Zero
+// means "don't set this limit".
+type CgroupLimits struct {
+	MemoryBytes int64
+	CPUs        float64
+}
+
+// createCgroup creates a cgroup v2 leaf for a container and writes its
+// resource limits, returning the leaf's path for the container process to
+// join via joinCgroup.
+func createCgroup(id string, limits CgroupLimits) (string, error) {
+	path := filepath.Join(cgroupRoot, id)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", fmt.Errorf("creating cgroup %q: %w", path, err)
+	}
+
+	if limits.MemoryBytes > 0 {
+		value := strconv.FormatInt(limits.MemoryBytes, 10)
+		if err := os.WriteFile(filepath.Join(path, "memory.max"), []byte(value), 0o644); err != nil {
+			return "", fmt.Errorf("setting memory.max: %w", err)
+		}
+	}
+
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriodMicros)
+		value := fmt.Sprintf("%d %d", quota, cpuPeriodMicros)
+		if err := os.WriteFile(filepath.Join(path, "cpu.max"), []byte(value), 0o644); err != nil {
+			return "", fmt.Errorf("setting cpu.max: %w", err)
+		}
+	}
+
+	return path, nil
+}
+
+// joinCgroup adds the calling process to the cgroup leaf at path.
+func joinCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(pid), 0o644); err != nil {
+		return fmt.Errorf("joining cgroup %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// removeCgroup tears down a cgroup leaf once its container has exited. The
+// kernel refuses to remove a cgroup with processes still in it, so this is
+// only meaningful after the container process has exited.
+func removeCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	return os.Remove(path)
+}
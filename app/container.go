@@ -0,0 +1,262 @@
+//go:build linux
+// +build linux
+
+// This file relies on Linux's per-OS-thread credential model (see
+// initContainer's runtime.LockOSThread call below) along with namespace and
+// pivot_root syscalls that only exist on Linux.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// reexecCommand is the hidden argv[1] docker-go recognizes as "this process
+// is the re-exec'd container init, not a fresh `run` invocation".
+const reexecCommand = "docker-go-init"
+
+// fullIDRangeSize is how many uids/gids setupContainer maps 1:1 into the
+// container's user namespace when it can (see setupContainer), covering
+// every id a real /etc/passwd entry is ever likely to use.
+const fullIDRangeSize = 65536
+
+// ContainerSpec is everything the container init needs to finish setting up
+// the sandbox and exec into the target command.
+type ContainerSpec struct {
+	Rootfs     string
+	Hostname   string
+	CgroupPath string
+	WorkingDir string
+	Env        []string
+	Credential *syscall.Credential
+	Command    string
+	Args       []string
+}
+
+// setupContainer builds the exec.Cmd that creates the container: it re-execs
+// docker-go itself (via /proc/self/exe) into a fresh pid/mount/uts/ipc/net/
+// user namespace, landing in initContainer below, which does pivot_root,
+// mounts /proc and /tmp and /dev, sets the hostname, joins the cgroup and
+// finally execve's the real target command.
+//
+// Re-executing is required rather than just unsharing namespaces in place:
+// CLONE_NEWNS et al. only take full effect for a brand-new process image,
+// and the Go runtime is already multithreaded by the time main() can do
+// anything, so there's no safe point to unshare mid-process. A fresh
+// /proc/self/exe invocation starts clean inside the new namespaces instead.
+func setupContainer(spec ContainerSpec) *exec.Cmd {
+	self := "/proc/self/exe"
+	if _, err := os.Stat(self); err != nil {
+		self = os.Args[0]
+	}
+
+	uidStr, gidStr := "-", "-"
+	if spec.Credential != nil {
+		uidStr = strconv.FormatUint(uint64(spec.Credential.Uid), 10)
+		gidStr = strconv.FormatUint(uint64(spec.Credential.Gid), 10)
+	}
+
+	// An unprivileged caller can only ever map a single id into the new user
+	// namespace (their own), so a non-root image USER has nothing to drop
+	// to: Setuid/Setgid to an id the kernel never mapped just fails with
+	// EINVAL. Running docker-go as real root lets us map the whole range
+	// 1:1 instead, so any resolved uid/gid is valid inside the namespace
+	// too. idRangeMapped tells initContainer which case it's in, so it can
+	// report the limitation clearly rather than let Setuid fail late.
+	idRangeMapped := os.Getuid() == 0
+	idRangeStr := "0"
+	if idRangeMapped {
+		idRangeStr = "1"
+	}
+
+	argv := append([]string{
+		reexecCommand,
+		spec.Rootfs,
+		spec.Hostname,
+		spec.CgroupPath,
+		spec.WorkingDir,
+		uidStr,
+		gidStr,
+		idRangeStr,
+		spec.Command,
+	}, spec.Args...)
+
+	cmd := exec.Command(self, argv...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = spec.Env
+
+	uidMappings := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	gidMappings := []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	if idRangeMapped {
+		uidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: fullIDRangeSize}}
+		gidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: fullIDRangeSize}}
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET | syscall.CLONE_NEWUSER,
+		UidMappings: uidMappings,
+		GidMappings: gidMappings,
+	}
+
+	return cmd
+}
+
+// initContainer is the body of the re-exec'd child: it runs as PID 1 inside
+// the new namespaces, finishes sandbox setup, then execve's the target
+// command so it replaces this process (and keeps being PID 1).
+func initContainer(args []string) {
+	// Credentials are per-OS-thread on Linux, and dropPrivileges below calls
+	// Setuid/Setgid directly rather than going through exec.Cmd's Credential
+	// field. Without pinning this goroutine to its OS thread, the Go
+	// scheduler could migrate it elsewhere before the Exec call at the
+	// bottom of this function runs, landing on a thread that never dropped
+	// privileges and silently keeping the container running as root.
+	runtime.LockOSThread()
+
+	if len(args) < 8 {
+		handleError("Error in container init", fmt.Errorf("expected at least 8 arguments, got %d", len(args)))
+	}
+
+	rootfs, hostname, cgroupPath, workdir, uidStr, gidStr, idRangeStr, command := args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7]
+	cmdArgs := args[8:]
+
+	if err := joinCgroup(cgroupPath); err != nil {
+		handleError("Error joining cgroup", err)
+	}
+
+	if err := syscall.Sethostname([]byte(hostname)); err != nil {
+		handleError("Error setting hostname", err)
+	}
+
+	if err := pivotRoot(rootfs); err != nil {
+		handleError("Error pivoting root", err)
+	}
+
+	if err := mountProc(); err != nil {
+		handleError("Error mounting /proc", err)
+	}
+
+	if err := mountTmpfs("/tmp"); err != nil {
+		handleError("Error mounting /tmp", err)
+	}
+
+	if err := mountTmpfs("/dev"); err != nil {
+		handleError("Error mounting /dev", err)
+	}
+
+	if workdir != "" {
+		if err := os.Chdir(workdir); err != nil {
+			handleError("Error changing to working dir", err)
+		}
+	}
+
+	if uidStr != "-" {
+		if err := dropPrivileges(uidStr, gidStr, idRangeStr == "1"); err != nil {
+			handleError("Error dropping privileges", err)
+		}
+	}
+
+	target, err := exec.LookPath(command)
+	if err != nil {
+		target = command // let execve report its own "not found" error
+	}
+
+	if err := syscall.Exec(target, append([]string{command}, cmdArgs...), os.Environ()); err != nil {
+		handleError("Error executing command", err)
+	}
+}
+
+// pivotRoot makes newRoot the process's root filesystem, replacing the
+// chroot the tool used to rely on. Unlike chroot, pivot_root actually
+// detaches the old root, so nothing extracted under newRoot can escape back
+// out through a leftover mount of the host filesystem.
+func pivotRoot(newRoot string) error {
+	// pivot_root requires newRoot to be a mount point, so bind-mount it
+	// onto itself.
+	if err := syscall.Mount(newRoot, newRoot, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind-mounting new root: %w", err)
+	}
+
+	oldRootRel := ".old_root"
+	oldRoot := filepath.Join(newRoot, oldRootRel)
+	if err := os.MkdirAll(oldRoot, 0o700); err != nil {
+		return fmt.Errorf("creating old root mountpoint: %w", err)
+	}
+
+	if err := syscall.PivotRoot(newRoot, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir to new root: %w", err)
+	}
+
+	if err := syscall.Unmount("/"+oldRootRel, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root: %w", err)
+	}
+
+	return os.RemoveAll("/" + oldRootRel)
+}
+
+// mountProc gives the container its own /proc, so tools like `ps` only see
+// the container's own process tree instead of the host's.
+func mountProc() error {
+	if err := os.MkdirAll("/proc", 0o555); err != nil {
+		return err
+	}
+
+	return syscall.Mount("proc", "/proc", "proc", 0, "")
+}
+
+// mountTmpfs mounts a fresh, empty tmpfs at target, the way dockerd gives
+// every container its own /tmp and /dev rather than sharing the host's.
+func mountTmpfs(target string) error {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+
+	return syscall.Mount("tmpfs", target, "tmpfs", 0, "")
+}
+
+// dropPrivileges switches the calling process to uid/gid, applying the
+// image config's User after root has finished the setup steps above that
+// need it (mounting, pivot_root, joining the cgroup). idRangeMapped reports
+// whether setupContainer mapped the full uid/gid range into this container's
+// user namespace (only possible when docker-go itself ran as real root): if
+// it didn't, only uid/gid 0 exist in the namespace, so anything else is
+// rejected up front instead of failing deep inside Setuid with a bare
+// EINVAL.
+func dropPrivileges(uidStr, gidStr string, idRangeMapped bool) error {
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return fmt.Errorf("parsing uid %q: %w", uidStr, err)
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("parsing gid %q: %w", gidStr, err)
+	}
+
+	if !idRangeMapped && (uid != 0 || gid != 0) {
+		return fmt.Errorf("image USER resolves to uid %d/gid %d, but only uid/gid 0 are mapped into the container's user namespace; run docker-go as root to map the full range and support non-root image users", uid, gid)
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ImageConfig is the subset of the OCI/Docker image config JSON (the blob
+// referenced by manifest.Config.Digest) that we need to seed the container
+// process with.
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	Os           string `json:"os"`
+	Config       struct {
+		Env        []string          `json:"Env"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Cmd        []string          `json:"Cmd"`
+		WorkingDir string            `json:"WorkingDir"`
+		User       string            `json:"User"`
+		Labels     map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// FetchImageConfig downloads (or reads from cache) and parses the image
+// config blob that manifest points at.
+func FetchImageConfig(client *RegistryClient, cache *BlobCache, manifest *Manifest) (*ImageConfig, error) {
+	path, err := FetchBlob(client, cache, manifest.Config.Digest, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching image config: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading image config: %w", err)
+	}
+
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("unmarshalling image config: %w", err)
+	}
+
+	return &config, nil
+}
+
+// resolveCommand picks argv for the container: override if the user gave
+// one on the CLI, otherwise the image's own Entrypoint+Cmd, just like
+// `docker run` does.
+func resolveCommand(config *ImageConfig, override []string) (string, []string, error) {
+	argv := override
+	if len(argv) == 0 {
+		argv = append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+	}
+
+	if len(argv) == 0 {
+		return "", nil, fmt.Errorf("image has no Entrypoint/Cmd and no command was given")
+	}
+
+	return argv[0], argv[1:], nil
+}
+
+// resolveEnv merges the image's declared environment with the variables
+// docker-go itself needs inside the container.
+func resolveEnv(config *ImageConfig) []string {
+	return append(append([]string{}, config.Config.Env...), "PID1=-[ns-process]- # ")
+}
+
+// resolveUser parses an image config User field ("uid[:gid]" or
+// "name[:group]") into numeric ids, consulting rootfs/etc/passwd for any
+// name that isn't already numeric. A blank user resolves to nil, meaning
+// "don't change credentials".
+func resolveUser(rootfs, user string) (*syscall.Credential, error) {
+	if user == "" {
+		return nil, nil
+	}
+
+	userPart, groupPart, hasGroup := strings.Cut(user, ":")
+
+	uid, gid, err := lookupUser(rootfs, userPart)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasGroup {
+		g, err := strconv.ParseUint(groupPart, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("resolving group %q: group-name lookup is not supported, use a numeric gid", groupPart)
+		}
+		gid = uint32(g)
+	}
+
+	return &syscall.Credential{Uid: uid, Gid: gid}, nil
+}
+
+// lookupUser resolves userPart to a uid/gid pair, parsing it as a number
+// first and falling back to a name lookup in rootfs/etc/passwd.
+func lookupUser(rootfs, userPart string) (uid, gid uint32, err error) {
+	if n, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		return uint32(n), 0, nil
+	}
+
+	passwdPath := filepath.Join(rootfs, "etc", "passwd")
+
+	// A layer can plant a symlink (e.g. "etc -> /") that would otherwise
+	// have os.ReadFile follow it straight out of rootfs and back onto the
+	// host filesystem, since we read this before the container is
+	// sandboxed by pivot_root. Resolve it first and refuse to read
+	// anything that escapes rootfs.
+	resolved, err := filepath.EvalSymlinks(passwdPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading /etc/passwd to resolve user %q: %w", userPart, err)
+	}
+	if err := requireWithin(rootfs, resolved); err != nil {
+		return 0, 0, fmt.Errorf("reading /etc/passwd to resolve user %q: %w", userPart, err)
+	}
+
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading /etc/passwd to resolve user %q: %w", userPart, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != userPart {
+			continue
+		}
+
+		u, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed uid for user %q: %w", userPart, err)
+		}
+		g, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed gid for user %q: %w", userPart, err)
+		}
+
+		return uint32(u), uint32(g), nil
+	}
+
+	return 0, 0, fmt.Errorf("user %q not found in /etc/passwd", userPart)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCommand(t *testing.T) {
+	entrypointAndCmd := ImageConfig{}
+	entrypointAndCmd.Config.Entrypoint = []string{"docker-entrypoint.sh"}
+	entrypointAndCmd.Config.Cmd = []string{"postgres"}
+
+	tests := []struct {
+		name     string
+		config   ImageConfig
+		override []string
+		wantCmd  string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			name:     "override takes precedence over image config",
+			config:   ImageConfig{},
+			override: []string{"echo", "hi"},
+			wantCmd:  "echo",
+			wantArgs: []string{"hi"},
+		},
+		{
+			name:     "entrypoint and cmd are concatenated",
+			config:   entrypointAndCmd,
+			wantCmd:  "docker-entrypoint.sh",
+			wantArgs: []string{"postgres"},
+		},
+		{
+			name:    "no override and no image command is an error",
+			config:  ImageConfig{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args, err := resolveCommand(&tt.config, tt.override)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveCommand: expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveCommand: unexpected error: %v", err)
+			}
+			if cmd != tt.wantCmd {
+				t.Fatalf("cmd = %q, want %q", cmd, tt.wantCmd)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("args = %v, want %v", args, tt.wantArgs)
+			}
+			for i := range args {
+				if args[i] != tt.wantArgs[i] {
+					t.Fatalf("args = %v, want %v", args, tt.wantArgs)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatalf("seeding rootfs: %v", err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/sh\npostgres:x:999:999:postgres:/var/lib/postgresql:/bin/sh\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatalf("seeding /etc/passwd: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		wantNil bool
+		wantUid uint32
+		wantGid uint32
+		wantErr bool
+	}{
+		{name: "empty user means no credential", user: "", wantNil: true},
+		{name: "numeric uid:gid", user: "1000:1000", wantUid: 1000, wantGid: 1000},
+		{name: "numeric uid without gid", user: "1000", wantUid: 1000, wantGid: 0},
+		{name: "named user resolved via /etc/passwd", user: "postgres", wantUid: 999, wantGid: 999},
+		{name: "named user with explicit numeric gid override", user: "postgres:0", wantUid: 999, wantGid: 0},
+		{name: "named group is unsupported", user: "postgres:postgres", wantErr: true},
+		{name: "unknown user", user: "nobody-here", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credential, err := resolveUser(rootfs, tt.user)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveUser(%q): expected error", tt.user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveUser(%q): unexpected error: %v", tt.user, err)
+			}
+			if tt.wantNil {
+				if credential != nil {
+					t.Fatalf("resolveUser(%q): expected nil credential, got %+v", tt.user, credential)
+				}
+				return
+			}
+			if credential == nil {
+				t.Fatalf("resolveUser(%q): expected a credential", tt.user)
+			}
+			if credential.Uid != tt.wantUid || credential.Gid != tt.wantGid {
+				t.Fatalf("resolveUser(%q) = uid %d gid %d, want uid %d gid %d", tt.user, credential.Uid, credential.Gid, tt.wantUid, tt.wantGid)
+			}
+		})
+	}
+}
+
+func TestResolveUserRejectsPasswdEscapingRootfs(t *testing.T) {
+	rootfs := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\n"), 0o644); err != nil {
+		t.Fatalf("seeding host passwd: %v", err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(rootfs, "etc")); err != nil {
+		t.Fatalf("seeding malicious symlink: %v", err)
+	}
+
+	if _, err := resolveUser(rootfs, "root"); err == nil {
+		t.Fatalf("resolveUser: expected rejection of /etc/passwd escaping rootfs via symlink")
+	}
+}
@@ -4,30 +4,36 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
 )
 
+type ManifestDescriptor struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Platform  struct {
+		Architecture string `json:"architecture"`
+		Os           string `json:"os"`
+	} `json:"platform,omitempty"`
+	Size int `json:"size"`
+}
+
 type Manifests struct {
-	Manifests []struct {
-		Digest    string `json:"digest"`
-		MediaType string `json:"mediaType"`
-		Platform  struct {
-			Architecture string `json:"architecture"`
-			Os           string `json:"os"`
-		} `json:"platform,omitempty"`
-		Size int `json:"size"`
-	} `json:"manifests"`
-	MediaType     string `json:"mediaType"`
-	SchemaVersion int    `json:"schemaVersion"`
+	Manifests     []ManifestDescriptor `json:"manifests"`
+	MediaType     string               `json:"mediaType"`
+	SchemaVersion int                  `json:"schemaVersion"`
+}
+
+type LayerDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int    `json:"size"`
+	Digest    string `json:"digest"`
 }
 
 type Manifest struct {
@@ -38,35 +44,14 @@ type Manifest struct {
 		Size      int    `json:"size"`
 		Digest    string `json:"digest"`
 	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"layers"`
+	Layers []LayerDescriptor `json:"layers"`
 }
 
 const (
-	getTokenURL       = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/%s:pull"
-	getManifestURL    = "https://registry.hub.docker.com/v2/library/%s/manifests/%s"
-	getLayerURL       = "https://registry.hub.docker.com/v2/library/%s/blobs/%s"
-	contentTypeHeader = "application/vnd.docker.distribution.manifest.v2+json"
-	imageFileName     = "image.tar"
-	tempDir           = "my-docker"
+	imageFileName = "image.tar"
+	tempDir       = "my-docker"
 )
 
-func isolateFilesystem(tempDir string) error {
-	err := os.MkdirAll(filepath.Join(tempDir, "/dev/null"), 06)
-	if err != nil {
-		return fmt.Errorf("Err while creating /dev/null: %v", err)
-	}
-
-	if err := syscall.Chroot(tempDir); err != nil {
-		return fmt.Errorf("Err while setting chroot: %v", err)
-	}
-
-	return nil
-}
-
 func handleError(msg string, err error) {
 	var exitError *exec.ExitError
 
@@ -78,219 +63,185 @@ func handleError(msg string, err error) {
 	}
 }
 
-func getRegistryAuthToken(image string) string {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(getTokenURL, image), nil)
-	if err != nil {
-		handleError("Error when creating request for auth token ", err)
-	}
-
-	res, err := http.DefaultClient.Do(req)
+// getImageFromRegistry pulls image's layers into path and returns its
+// parsed image config, which main uses to seed the container process.
+func getImageFromRegistry(image, path string, platform Platform, maxConcurrentDownloads int) *ImageConfig {
+	client, err := NewRegistryClient(image, platform)
 	if err != nil {
-		fmt.Printf("client: error making http request for auth token: %s\n", err)
-		os.Exit(1)
+		handleError("Error when authenticating with registry", err)
 	}
 
-	defer res.Body.Close()
-	resBody, err := io.ReadAll(res.Body)
+	cache, err := NewBlobCache()
 	if err != nil {
-		fmt.Printf("client: could not read response body: %s\n", err)
-		os.Exit(1)
-	}
-
-	var tokenResponse struct {
-		Token string `json:"token"`
+		handleError("Error when opening blob cache", err)
 	}
 
-	if err := json.Unmarshal(resBody, &tokenResponse); err != nil {
-		fmt.Printf("client: could not unmarshal response body: %s\n", err)
-		os.Exit(1)
-	}
-
-	// fmt.Println(fmt.Sprintf("token: %s", tokenResponse.Token))
-
-	return tokenResponse.Token
-}
-
-func getImageManifest(token, image, version string) *Manifest {
-	// fmt.Println(fmt.Sprintf(getManifestURL, image, version))
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(getManifestURL, image, version), nil)
+	manifest, err := client.GetManifest()
 	if err != nil {
-		handleError("Error when creating request", err)
+		handleError("Error when fetching image manifest", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Set("Accept", contentTypeHeader)
-
-	res, err := http.DefaultClient.Do(req)
+	config, err := FetchImageConfig(client, cache, manifest)
 	if err != nil {
-		handleError("Error when executing image manifest request", err)
+		handleError("Error when fetching image config", err)
 	}
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		handleError("Error when parsing response body", err)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		handleError("Error when creating directory", err)
 	}
-	defer res.Body.Close()
-
-	// fmt.Printf("resBody: %s\n", resBody)
 
-	var manifest Manifest
-
-	if err := json.Unmarshal(resBody, &manifest); err != nil {
-		handleError("Error when parsing JSON response for image manifest", err)
+	if err := pullAndExtractLayers(client, cache, manifest, path, maxConcurrentDownloads); err != nil {
+		handleError("Error when pulling layers", err)
 	}
 
-	return &manifest
+	return config
 }
 
-func pullDockerLayers(token, image, digest string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(getLayerURL, image, digest), nil)
-	if err != nil {
-		handleError("Error when creating request to get layer", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		handleError("Error when executing layer request", err)
-	}
-	defer res.Body.Close()
-
-	layerFile, err := os.Create(fmt.Sprintf("%s.tar.gz", digest[7:]))
-	if err != nil {
-		handleError("Error when creating file", err)
-	}
-	defer layerFile.Close()
-
-	_, err = io.Copy(layerFile, res.Body)
-	if err != nil {
-		handleError("Error when writing layer to file", err)
-	}
-
-	return layerFile.Name(), nil
+// runFlags are the flags docker-go accepts before the image reference.
+type runFlags struct {
+	Platform               Platform
+	Memory                 int64   // bytes; 0 means unlimited
+	CPUs                   float64 // cpu count; 0 means unlimited
+	MaxConcurrentDownloads int     // 0 means use the default
 }
 
-func getImageFromRegistry(image, version, path string) {
-	// first we need to get the auth token to make calls to the registry
-	token := getRegistryAuthToken(image)
-
-	manifest := getImageManifest(token, image, version)
-
-	layerNames := []string{}
-	for _, manifest := range manifest.Layers {
-		layerName, err := pullDockerLayers(token, image, manifest.Digest)
-		if err != nil {
-			handleError("Error when pulling layer", err)
+// parseRunFlags consumes "--platform os/arch", "--memory N", "--cpus N" and
+// "--max-concurrent-downloads N" flags from the front of a run invocation's
+// arguments, returning them alongside the remaining <image> [command [args...]].
+func parseRunFlags(args []string) (runFlags, []string) {
+	var flags runFlags
+
+	for len(args) >= 2 {
+		switch args[0] {
+		case "--platform":
+			platformOS, arch, ok := strings.Cut(args[1], "/")
+			if !ok {
+				handleError("Error when parsing --platform", fmt.Errorf("expected os/arch, got %q", args[1]))
+			}
+			flags.Platform = Platform{OS: platformOS, Architecture: arch}
+		case "--memory":
+			bytes, err := parseMemory(args[1])
+			if err != nil {
+				handleError("Error when parsing --memory", err)
+			}
+			flags.Memory = bytes
+		case "--cpus":
+			cpus, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				handleError("Error when parsing --cpus", err)
+			}
+			flags.CPUs = cpus
+		case "--max-concurrent-downloads":
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				handleError("Error when parsing --max-concurrent-downloads", err)
+			}
+			flags.MaxConcurrentDownloads = n
+		default:
+			return flags, args
 		}
 
-		layerNames = append(layerNames, layerName)
-	}
-
-	// printCurrentFilesInDir()
-
-	// fmt.Printf("Layer names: %v\n", layerNames)
-
-	// fmt.Printf("Path: %s\n", path)
-
-	// check permissions for target directory
-	err := os.MkdirAll(path, 0777)
-	if err != nil {
-		handleError("Error when creating directory", err)
+		args = args[2:]
 	}
 
-	for _, layerName := range layerNames {
-		// fmt.Printf("Layer name: %s\n", layerName)
-
-		_, err := os.Stat(layerName)
-		if err != nil {
-			fmt.Println("Error when getting file info:", err)
-			return
-		}
-
-		// fmt.Println("File permissions:", info.Mode())
+	return flags, args
+}
 
-		err = extractTar(layerName, path)
-		if err != nil {
-			handleError("Error when extracting tar", err)
+// parseMemory parses a --memory value like "512m" or "1g" into bytes.
+func parseMemory(raw string) (int64, error) {
+	multiplier := int64(1)
+
+	if len(raw) > 0 {
+		switch raw[len(raw)-1] {
+		case 'k', 'K':
+			multiplier, raw = 1024, raw[:len(raw)-1]
+		case 'm', 'M':
+			multiplier, raw = 1024*1024, raw[:len(raw)-1]
+		case 'g', 'G':
+			multiplier, raw = 1024*1024*1024, raw[:len(raw)-1]
 		}
 	}
 
-	// printCurrentFilesInDir()
-}
-
-func printCurrentFilesInDir() {
-	files, err := os.ReadDir(".")
+	n, err := strconv.ParseInt(raw, 10, 64)
 	if err != nil {
-		handleError("Error when reading directory", err)
-	}
-
-	fmt.Println("\n\n****** CURRENT FILES ******")
-
-	for _, file := range files {
-		fmt.Println(file.Name())
+		return 0, fmt.Errorf("invalid memory value: %w", err)
 	}
 
-	fmt.Println("****** END FILES ******\n")
+	return n * multiplier, nil
 }
 
-func extractTar(src, dest string) error {
-	cmd := exec.Command("tar", "-xzvf", src, "-C", dest)
-
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("Error when extracting tar: %v", err)
+// randomID generates a short hex id used as both the container's hostname
+// and its cgroup leaf name.
+func randomID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating container id: %w", err)
 	}
 
-	return nil
+	return hex.EncodeToString(buf), nil
 }
 
-// Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
+// Usage: your_docker.sh run [--platform os/arch] [--memory N] [--cpus N] [--max-concurrent-downloads N] <image>[:tag|@digest] [command [arg1 arg2 ...]]
 func main() {
-	imageAndVersion := strings.Split(os.Args[2], ":")
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
-
-	image := imageAndVersion[0]
-	version := "latest"
+	if len(os.Args) > 1 && os.Args[1] == reexecCommand {
+		initContainer(os.Args[2:])
+		return
+	}
 
-	if len(imageAndVersion) == 2 {
-		version = imageAndVersion[1]
+	flags, runArgs := parseRunFlags(os.Args[2:])
+	if len(runArgs) == 0 {
+		handleError("Error parsing arguments", fmt.Errorf("usage: %s run [--platform os/arch] [--memory N] [--cpus N] [--max-concurrent-downloads N] <image>[:tag|@digest] [command [arg1 arg2 ...]]", os.Args[0]))
 	}
+	image := runArgs[0]
+	override := runArgs[1:]
 
-	tempDir, err := os.MkdirTemp("", tempDir)
+	rootfs, err := os.MkdirTemp("", tempDir)
 	if err != nil {
 		fmt.Printf("Error creating temporary directory: %v\n", err)
 		os.Exit(1)
 	}
-	defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(rootfs)
 
-	getImageFromRegistry(image, version, tempDir)
+	imageConfig := getImageFromRegistry(image, rootfs, flags.Platform, flags.MaxConcurrentDownloads)
 
-	err = isolateFilesystem(tempDir)
+	credential, err := resolveUser(rootfs, imageConfig.Config.User)
 	if err != nil {
-		handleError("Error when isolating filesystem", err)
+		handleError("Error when resolving image user", err)
 	}
 
-	cmd := exec.Command(command, args...)
-
-	// we need to guard the processs tree so the program we're running
-	// is only able to see the process tree that we want it to see.
-	// to do that, we'll use PID namespaces to ensure the program
-	// has its own process tree. The process being executed must see itself as PID 1.
-
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-
-	cmd.Env = []string{"PID1=-[ns-process]- # "}
+	command, args, err := resolveCommand(imageConfig, override)
+	if err != nil {
+		handleError("Error when resolving command", err)
+	}
 
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
+	id, err := randomID()
+	if err != nil {
+		handleError("Error setting up container", err)
 	}
 
-	err = cmd.Run()
+	cgroupPath, err := createCgroup(id, CgroupLimits{MemoryBytes: flags.Memory, CPUs: flags.CPUs})
 	if err != nil {
+		handleError("Error setting up cgroup", err)
+	}
+	defer removeCgroup(cgroupPath)
+
+	// We re-exec ourselves into a fresh set of Linux namespaces (pid, mount,
+	// uts, ipc, net, user) rather than just chrooting, so the program we run
+	// gets its own process tree, filesystem, hostname and network stack
+	// instead of merely a restricted view of the host's. It must see itself
+	// as PID 1.
+	cmd := setupContainer(ContainerSpec{
+		Rootfs:     rootfs,
+		Hostname:   id,
+		CgroupPath: cgroupPath,
+		WorkingDir: imageConfig.Config.WorkingDir,
+		Env:        resolveEnv(imageConfig),
+		Credential: credential,
+		Command:    command,
+		Args:       args,
+	})
+
+	if err := cmd.Run(); err != nil {
 		handleError("Error when executing command", err)
 	}
 
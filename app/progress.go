@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var spinnerFrames = []rune{'|', '/', '-', '\\'}
+
+// progressReporter renders one line per layer to stderr ("<spinner> <digest>
+// <done>/<total> bytes"), redrawing the block in place with ANSI cursor
+// moves as downloads progress. It's a no-op when stderr isn't a terminal,
+// so piped output (CI logs, `docker-go run ... > log`) stays clean.
+type progressReporter struct {
+	mu      sync.Mutex
+	enabled bool
+	digests []string
+	total   []int64
+	done    []int64
+	drawn   bool
+	spin    int
+}
+
+func newProgressReporter(layers []LayerDescriptor) *progressReporter {
+	p := &progressReporter{enabled: isTerminal(os.Stderr)}
+
+	for _, layer := range layers {
+		p.digests = append(p.digests, layer.Digest)
+		p.total = append(p.total, int64(layer.Size))
+	}
+	p.done = make([]int64, len(layers))
+
+	return p
+}
+
+// add records n more bytes read for layer i and redraws.
+func (p *progressReporter) add(i int, n int64) {
+	if !p.enabled {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done[i] += n
+	p.render()
+}
+
+func (p *progressReporter) render() {
+	if p.drawn {
+		fmt.Fprintf(os.Stderr, "\x1b[%dA", len(p.digests))
+	}
+	p.drawn = true
+
+	frame := spinnerFrames[p.spin%len(spinnerFrames)]
+	p.spin++
+
+	for i, digest := range p.digests {
+		short := digest
+		if idx := strings.IndexByte(short, ':'); idx != -1 && len(short) > idx+13 {
+			short = short[:idx+13] // "sha256:" + 12 hex chars, like `docker pull`
+		}
+
+		indicator := frame
+		if p.total[i] > 0 && p.done[i] >= p.total[i] {
+			indicator = '✓'
+		}
+
+		fmt.Fprintf(os.Stderr, "\x1b[2K%c %s %d/%d bytes\n", indicator, short, p.done[i], p.total[i])
+	}
+}
+
+// finish leaves the final state of the progress block on screen.
+func (p *progressReporter) finish() {
+	if !p.enabled {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.render()
+}
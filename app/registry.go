@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const defaultRegistry = "registry-1.docker.io"
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestAcceptHeader advertises every media type we know how to handle, so
+// the registry can hand back a manifest list/index for multi-arch images
+// instead of silently picking an architecture for us.
+var manifestAcceptHeader = strings.Join([]string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}, ", ")
+
+// Platform identifies the OS/architecture to select when a registry returns
+// a manifest list or OCI index instead of a single manifest.
+type Platform struct {
+	OS           string
+	Architecture string
+}
+
+// reference is a parsed image reference, e.g. "ghcr.io/foo/bar@sha256:..." or
+// "alpine:3.19", which is shorthand for "registry-1.docker.io/library/alpine:3.19".
+type reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseReference splits an image reference into registry, repository and
+// tag/digest, applying the same defaulting rules as the Docker CLI: no
+// registry means Docker Hub, and no namespace on Docker Hub means "library".
+func parseReference(raw string) reference {
+	ref := reference{Registry: defaultRegistry, Tag: "latest"}
+
+	name := raw
+	if idx := strings.Index(name, "@"); idx != -1 {
+		ref.Digest = name[idx+1:]
+		name = name[:idx]
+	} else if idx := strings.LastIndex(name, ":"); idx != -1 && !strings.Contains(name[idx:], "/") {
+		ref.Tag = name[idx+1:]
+		name = name[:idx]
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) > 1 && (strings.Contains(parts[0], ".") || strings.Contains(parts[0], ":") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		parts = parts[1:]
+	}
+
+	if ref.Registry == defaultRegistry && len(parts) == 1 {
+		parts = append([]string{"library"}, parts...)
+	}
+
+	ref.Repository = strings.Join(parts, "/")
+
+	return ref
+}
+
+// versionOrDigest is what goes in the manifest URL path: the tag, or the
+// digest when the reference pins one.
+func (r reference) versionOrDigest() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// scheme is the URL scheme to talk to this reference's registry with.
+// Local/insecure registries (as used by tests and dev registries) get
+// plain http; everything else gets https.
+func (r reference) scheme() string {
+	if r.Registry == "localhost" || strings.HasPrefix(r.Registry, "localhost:") || strings.HasPrefix(r.Registry, "127.0.0.1:") {
+		return "http"
+	}
+	return "https"
+}
+
+// RegistryClient talks to a single OCI/Docker distribution registry on
+// behalf of one image reference, handling the auth challenge/token dance
+// and normal registry-hub.docker.com auth the same way.
+type RegistryClient struct {
+	httpClient *http.Client
+	ref        reference
+	platform   Platform
+
+	authHeader string // value to set as the Authorization header on every request
+}
+
+// defaultPlatform is the platform we select from a manifest list/index when
+// the caller doesn't ask for a specific one.
+func defaultPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// NewRegistryClient parses image into a reference and authenticates against
+// its registry, returning a client ready to fetch manifests and blobs.
+// platform picks which entry to resolve to when the image is a manifest
+// list/index; the zero value means "use this host's OS/architecture".
+func NewRegistryClient(image string, platform Platform) (*RegistryClient, error) {
+	if platform == (Platform{}) {
+		platform = defaultPlatform()
+	}
+
+	c := &RegistryClient{
+		httpClient: http.DefaultClient,
+		ref:        parseReference(image),
+		platform:   platform,
+	}
+
+	if err := c.authenticate(); err != nil {
+		return nil, fmt.Errorf("authenticating against %s: %w", c.ref.Registry, err)
+	}
+
+	return c, nil
+}
+
+// authChallenge is the parsed form of a Www-Authenticate header.
+type authChallenge struct {
+	Scheme  string // "Bearer" or "Basic"
+	Realm   string
+	Service string
+	Scope   string
+}
+
+// authenticate probes the registry's base endpoint to discover how it wants
+// to be authenticated, then fetches a bearer token or stores basic auth
+// credentials for subsequent requests.
+func (c *RegistryClient) authenticate() error {
+	challenge, err := c.probe()
+	if err != nil {
+		return err
+	}
+
+	if challenge == nil {
+		// registry doesn't require auth at all
+		return nil
+	}
+
+	switch challenge.Scheme {
+	case "Bearer":
+		token, err := c.fetchBearerToken(*challenge)
+		if err != nil {
+			return fmt.Errorf("fetching bearer token: %w", err)
+		}
+		c.authHeader = "Bearer " + token
+	case "Basic":
+		user, pass := registryCredentials(c.ref.Registry)
+		c.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	default:
+		return fmt.Errorf("unsupported auth scheme %q", challenge.Scheme)
+	}
+
+	return nil
+}
+
+// probe issues a GET /v2/ request and returns the parsed Www-Authenticate
+// challenge, or nil if the registry answered 200 without one.
+func (c *RegistryClient) probe() (*authChallenge, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/v2/", c.ref.scheme(), c.ref.Registry), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+
+	header := res.Header.Get("Www-Authenticate")
+	if header == "" {
+		return nil, fmt.Errorf("registry replied %s with no Www-Authenticate header", res.Status)
+	}
+
+	challenge := parseWWWAuthenticate(header)
+	// the /v2/ probe carries no scope, so build one for the image we actually want
+	if challenge.Scope == "" {
+		challenge.Scope = fmt.Sprintf("repository:%s:pull", c.ref.Repository)
+	}
+
+	return &challenge, nil
+}
+
+// parseWWWAuthenticate parses a header like:
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+func parseWWWAuthenticate(header string) authChallenge {
+	scheme, rest, _ := strings.Cut(header, " ")
+	challenge := authChallenge{Scheme: scheme}
+
+	for _, field := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch strings.TrimSpace(key) {
+		case "realm":
+			challenge.Realm = value
+		case "service":
+			challenge.Service = value
+		case "scope":
+			challenge.Scope = value
+		}
+	}
+
+	return challenge
+}
+
+// fetchBearerToken requests a token from the realm the registry advertised,
+// attaching basic auth credentials when we have any for this registry so
+// private repos resolve to a token with pull access instead of anonymous.
+func (c *RegistryClient) fetchBearerToken(challenge authChallenge) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, challenge.Realm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	q := req.URL.Query()
+	if challenge.Service != "" {
+		q.Set("service", challenge.Service)
+	}
+	if challenge.Scope != "" {
+		q.Set("scope", challenge.Scope)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if user, pass := registryCredentials(c.ref.Registry); user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint replied %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", fmt.Errorf("unmarshalling token response: %w", err)
+	}
+
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+// dockerConfig mirrors the bits of ~/.docker/config.json we care about.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"` // base64("user:pass")
+	} `json:"auths"`
+}
+
+// registryCredentials resolves username/password for registry, preferring
+// $DOCKER_USERNAME/$DOCKER_PASSWORD and falling back to ~/.docker/config.json.
+func registryCredentials(registry string) (user, pass string) {
+	if u, p := os.Getenv("DOCKER_USERNAME"), os.Getenv("DOCKER_PASSWORD"); u != "" {
+		return u, p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", ""
+	}
+
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return "", ""
+	}
+
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", ""
+	}
+
+	entry, ok := cfg.Auths[registry]
+	if !ok {
+		return "", ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", ""
+	}
+
+	user, pass, _ = strings.Cut(string(decoded), ":")
+	return user, pass
+}
+
+// GetManifest fetches the manifest for this client's reference. When the
+// registry answers with a manifest list or OCI index, it picks the entry
+// matching c.platform and recurses into that child manifest.
+func (c *RegistryClient) GetManifest() (*Manifest, error) {
+	return c.getManifest(c.ref.versionOrDigest())
+}
+
+func (c *RegistryClient) getManifest(versionOrDigest string) (*Manifest, error) {
+	body, mediaType, err := c.fetchManifest(versionOrDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		var index Manifests
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("unmarshalling manifest list: %w", err)
+		}
+
+		child, err := selectManifest(index, c.platform)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.getManifest(child.Digest)
+	default:
+		var manifest Manifest
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return nil, fmt.Errorf("unmarshalling manifest: %w", err)
+		}
+
+		return &manifest, nil
+	}
+}
+
+// selectManifest picks the manifest list entry matching platform.
+func selectManifest(index Manifests, platform Platform) (*ManifestDescriptor, error) {
+	for i := range index.Manifests {
+		entry := &index.Manifests[i]
+		if entry.Platform.Architecture == platform.Architecture && entry.Platform.Os == platform.OS {
+			return entry, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest for platform %s/%s in manifest list", platform.OS, platform.Architecture)
+}
+
+// fetchManifest issues the manifest GET for versionOrDigest and returns the
+// raw body along with the mediaType the registry reported.
+func (c *RegistryClient) fetchManifest(versionOrDigest string) ([]byte, string, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", c.ref.scheme(), c.ref.Registry, c.ref.Repository, versionOrDigest)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	c.setAuth(req)
+	req.Header.Set("Accept", manifestAcceptHeader)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("manifest request for %s replied %s: %s", c.ref.Repository, res.Status, body)
+	}
+
+	var mediaType struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(body, &mediaType); err != nil {
+		return nil, "", fmt.Errorf("unmarshalling manifest: %w", err)
+	}
+
+	return body, mediaType.MediaType, nil
+}
+
+// GetBlob streams the blob (layer or config) identified by digest. The
+// caller is responsible for closing the returned body.
+func (c *RegistryClient) GetBlob(digest string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", c.ref.scheme(), c.ref.Registry, c.ref.Repository, digest)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAuth(req)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, fmt.Errorf("blob request for %s replied %s", digest, res.Status)
+	}
+
+	return res.Body, nil
+}
+
+func (c *RegistryClient) setAuth(req *http.Request) {
+	if c.authHeader != "" {
+		req.Header.Set("Authorization", c.authHeader)
+	}
+}
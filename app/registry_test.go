@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const dockerManifestListFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:amd64digest", "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:arm64digest", "platform": {"architecture": "arm64", "os": "linux"}}
+  ]
+}`
+
+const ociIndexFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:ociamd64digest", "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:ociarm64digest", "platform": {"architecture": "arm64", "os": "linux"}}
+  ]
+}`
+
+const singleManifestFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 1, "digest": "sha256:configdigest"},
+  "layers": [
+    {"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 2, "digest": "sha256:layerdigest"}
+  ]
+}`
+
+// newManifestListServer serves indexFixture at /v2/test/repo/manifests/latest
+// and singleManifestFixture at /v2/test/repo/manifests/<matchDigest>, failing
+// the test if any other digest is requested.
+func newManifestListServer(t *testing.T, indexFixture, matchDigest string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v2/test/repo/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(indexFixture))
+	})
+	mux.HandleFunc(fmt.Sprintf("/v2/test/repo/manifests/%s", matchDigest), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(singleManifestFixture))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestGetManifestResolvesDockerManifestList(t *testing.T) {
+	server := newManifestListServer(t, dockerManifestListFixture, "sha256:amd64digest")
+	defer server.Close()
+
+	client := clientForTest(t, server, Platform{OS: "linux", Architecture: "amd64"})
+
+	manifest, err := client.GetManifest()
+	if err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+
+	if manifest.Layers[0].Digest != "sha256:layerdigest" {
+		t.Errorf("got layer digest %q, want sha256:layerdigest", manifest.Layers[0].Digest)
+	}
+}
+
+func TestGetManifestResolvesOCIIndex(t *testing.T) {
+	server := newManifestListServer(t, ociIndexFixture, "sha256:ociarm64digest")
+	defer server.Close()
+
+	client := clientForTest(t, server, Platform{OS: "linux", Architecture: "arm64"})
+
+	manifest, err := client.GetManifest()
+	if err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+
+	if manifest.Config.Digest != "sha256:configdigest" {
+		t.Errorf("got config digest %q, want sha256:configdigest", manifest.Config.Digest)
+	}
+}
+
+func TestGetManifestNoMatchingPlatform(t *testing.T) {
+	server := newManifestListServer(t, dockerManifestListFixture, "sha256:amd64digest")
+	defer server.Close()
+
+	client := clientForTest(t, server, Platform{OS: "windows", Architecture: "amd64"})
+
+	if _, err := client.GetManifest(); err == nil {
+		t.Fatal("GetManifest() expected error for unmatched platform, got nil")
+	}
+}
+
+// clientForTest builds a RegistryClient pointed at server's host, bypassing
+// NewRegistryClient's auth dance since the test server requires none.
+func clientForTest(t *testing.T, server *httptest.Server, platform Platform) *RegistryClient {
+	t.Helper()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	return &RegistryClient{
+		httpClient: server.Client(),
+		ref:        reference{Registry: host, Repository: "test/repo", Tag: "latest"},
+		platform:   platform,
+	}
+}
+
+func TestDefaultPlatformMatchesRuntime(t *testing.T) {
+	p := defaultPlatform()
+	if p.OS != runtime.GOOS || p.Architecture != runtime.GOARCH {
+		t.Errorf("defaultPlatform() = %+v, want %s/%s", p, runtime.GOOS, runtime.GOARCH)
+	}
+}
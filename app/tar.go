@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mediaTypeLayerTarGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeLayerTar     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeOCILayerTar  = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+	whiteoutPrefix        = ".wh."
+	whiteoutOpaqueMarker  = whiteoutPrefix + whiteoutPrefix + ".opq"
+	xattrPAXRecordPrefix  = "SCHILY.xattr."
+)
+
+// extractLayer decompresses body according to its layer mediaType and
+// unpacks the resulting tar stream into dest, applying whiteouts as it goes.
+// It never touches disk for the compressed form: everything is streamed
+// straight from the HTTP response body.
+func extractLayer(body io.Reader, mediaType, dest string) error {
+	var r io.Reader
+
+	switch mediaType {
+	case mediaTypeLayerTarGzip, mediaTypeOCILayerGzip:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("opening gzip layer: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	case mediaTypeOCILayerZstd:
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("opening zstd layer: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	case mediaTypeLayerTar, mediaTypeOCILayerTar:
+		r = body
+	default:
+		return fmt.Errorf("unsupported layer media type %q", mediaType)
+	}
+
+	return extractTar(r, dest)
+}
+
+// extractTar streams a tar archive from r into dest. Entries named
+// ".wh.<name>" delete <name> from dest instead of being extracted, and a
+// ".wh..wh..opq" entry clears its directory first, matching the OCI image
+// layer spec's whiteout semantics for layer overlay.
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar entry: %w", err)
+		}
+
+		name := filepath.Clean(header.Name)
+		dir, base := filepath.Split(name)
+
+		if base == whiteoutOpaqueMarker {
+			dirPath, err := safeJoin(dest, dir)
+			if err != nil {
+				return fmt.Errorf("tar entry %q: %w", header.Name, err)
+			}
+			if err := clearDir(dirPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := safeJoin(dest, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return fmt.Errorf("tar entry %q: %w", header.Name, err)
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("applying whiteout for %q: %w", target, err)
+			}
+			continue
+		}
+
+		targetPath, err := safeJoin(dest, name)
+		if err != nil {
+			return fmt.Errorf("tar entry %q: %w", header.Name, err)
+		}
+
+		if err := extractEntry(tr, header, dest, targetPath); err != nil {
+			return fmt.Errorf("extracting %q: %w", header.Name, err)
+		}
+	}
+}
+
+// safeJoin joins dest and name the way filepath.Join would, but rejects any
+// result that escapes dest (Zip-Slip: "../../etc/passwd" style entries).
+func safeJoin(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+
+	if err := requireWithin(dest, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// requireWithin reports an error if target does not resolve to a path inside
+// dest, the way safeJoin does for a dest-relative name. Callers that already
+// have an absolute candidate path (rather than a tar-entry-relative name)
+// use this directly.
+func requireWithin(dest, target string) error {
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return fmt.Errorf("path escapes destination %q", dest)
+	}
+
+	return nil
+}
+
+// clearDir removes dir's contents (but not dir itself), implementing the
+// ".wh..wh..opq" opaque-directory whiteout.
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading opaque dir %q: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("clearing opaque dir %q: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// extractEntry writes a single tar entry to targetPath, preserving type,
+// mode, ownership, mtime and extended attributes.
+func extractEntry(tr *tar.Reader, header *tar.Header, dest, targetPath string) error {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(f, tr)
+		closeErr := f.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	case tar.TypeSymlink:
+		os.Remove(targetPath)
+		if err := os.Symlink(header.Linkname, targetPath); err != nil {
+			return err
+		}
+		return nil // symlinks have no mode/owner/mtime of their own to set here
+	case tar.TypeLink:
+		linkTarget, err := safeJoin(dest, filepath.Clean(header.Linkname))
+		if err != nil {
+			return err
+		}
+		os.Remove(targetPath)
+		if err := os.Link(linkTarget, targetPath); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(header.Mode)
+		switch header.Typeflag {
+		case tar.TypeChar:
+			mode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			mode |= syscall.S_IFBLK
+		case tar.TypeFifo:
+			mode |= syscall.S_IFIFO
+		}
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		os.Remove(targetPath)
+		if err := unix.Mknod(targetPath, mode, int(dev)); err != nil {
+			return fmt.Errorf("mknod: %w", err)
+		}
+	default:
+		return nil
+	}
+
+	if err := os.Lchown(targetPath, header.Uid, header.Gid); err != nil && !os.IsPermission(err) {
+		return fmt.Errorf("chown: %w", err)
+	}
+
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, xattrPAXRecordPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(targetPath, name, []byte(value), 0); err != nil && err != unix.ENOTSUP {
+			return fmt.Errorf("setting xattr %q: %w", name, err)
+		}
+	}
+
+	mtime := header.ModTime
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	if err := os.Chtimes(targetPath, mtime, mtime); err != nil {
+		return fmt.Errorf("chtimes: %w", err)
+	}
+
+	return nil
+}
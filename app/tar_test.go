@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildTar writes entries into a tar stream. Each entry is a name plus the
+// file content to write (empty for directories/whiteouts).
+func buildTar(t *testing.T, entries map[string]string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for name, content := range entries {
+		header := &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("writing header for %q: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("writing content for %q: %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+
+	return &buf
+}
+
+func TestExtractTarRegularFile(t *testing.T) {
+	dest := t.TempDir()
+	archive := buildTar(t, map[string]string{"hello.txt": "hi"})
+
+	if err := extractTar(archive, dest); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "hello.txt"))
+	if err != nil {
+		t.Fatalf("reading extracted file: %v", err)
+	}
+	if string(got) != "hi" {
+		t.Fatalf("content = %q, want %q", got, "hi")
+	}
+}
+
+func TestExtractTarWhiteoutRemovesSibling(t *testing.T) {
+	dest := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dest, "app"), 0o755); err != nil {
+		t.Fatalf("seeding dest: %v", err)
+	}
+	victim := filepath.Join(dest, "app", "config")
+	if err := os.WriteFile(victim, []byte("data"), 0o644); err != nil {
+		t.Fatalf("seeding victim file: %v", err)
+	}
+
+	archive := buildTar(t, map[string]string{"app/.wh.config": ""})
+	if err := extractTar(archive, dest); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	if _, err := os.Stat(victim); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be removed, stat err = %v", victim, err)
+	}
+}
+
+func TestExtractTarRejectsWhiteoutZipSlip(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "etc", "shadow")
+	if err := os.MkdirAll(filepath.Dir(victim), 0o755); err != nil {
+		t.Fatalf("seeding victim dir: %v", err)
+	}
+	if err := os.WriteFile(victim, []byte("root:x:0:0"), 0o644); err != nil {
+		t.Fatalf("seeding victim file: %v", err)
+	}
+
+	rel, err := filepath.Rel(dest, victim)
+	if err != nil {
+		t.Fatalf("computing rel path: %v", err)
+	}
+	whiteoutName := filepath.Join(filepath.Dir(rel), ".wh."+filepath.Base(rel))
+
+	archive := buildTar(t, map[string]string{whiteoutName: ""})
+	if err := extractTar(archive, dest); err == nil {
+		t.Fatalf("extractTar: expected escaping whiteout to be rejected")
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("victim outside dest must survive a rejected whiteout, stat err = %v", err)
+	}
+}
+
+func TestExtractTarRejectsOpaqueMarkerZipSlip(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "keep.txt")
+	if err := os.WriteFile(victim, []byte("data"), 0o644); err != nil {
+		t.Fatalf("seeding victim file: %v", err)
+	}
+
+	rel, err := filepath.Rel(dest, outside)
+	if err != nil {
+		t.Fatalf("computing rel path: %v", err)
+	}
+	opaqueName := filepath.Join(rel, whiteoutOpaqueMarker)
+
+	archive := buildTar(t, map[string]string{opaqueName: ""})
+	if err := extractTar(archive, dest); err == nil {
+		t.Fatalf("extractTar: expected escaping opaque marker to be rejected")
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("victim outside dest must survive a rejected opaque marker, stat err = %v", err)
+	}
+}
+
+func TestExtractTarRejectsRegularEntryZipSlip(t *testing.T) {
+	dest := t.TempDir()
+	archive := buildTar(t, map[string]string{"../../etc/passwd": "pwned"})
+
+	if err := extractTar(archive, dest); err == nil {
+		t.Fatalf("extractTar: expected escaping regular entry to be rejected")
+	}
+}